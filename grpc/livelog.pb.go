@@ -0,0 +1,211 @@
+// Code generated by protoc-gen-go and protoc-gen-go-grpc from
+// livelog.proto. DO NOT EDIT.
+
+package grpc
+
+import (
+	"context"
+
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/grpc"
+)
+
+// LogChunk is a single slice of a log's byte stream. Id is only
+// meaningful on the first message of a Push, or to select which log a
+// Tail reads from the response side.
+type LogChunk struct {
+	Id     string `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	Data   []byte `protobuf:"bytes,2,opt,name=data,proto3" json:"data,omitempty"`
+	Offset int64  `protobuf:"varint,3,opt,name=offset,proto3" json:"offset,omitempty"`
+}
+
+func (m *LogChunk) Reset()         { *m = LogChunk{} }
+func (m *LogChunk) String() string { return proto.CompactTextString(m) }
+func (*LogChunk) ProtoMessage()    {}
+
+// PushAck acknowledges a completed Push, reporting how many bytes were
+// committed to the backing stream.
+type PushAck struct {
+	BytesReceived int64 `protobuf:"varint,1,opt,name=bytes_received,json=bytesReceived,proto3" json:"bytes_received,omitempty"`
+}
+
+func (m *PushAck) Reset()         { *m = PushAck{} }
+func (m *PushAck) String() string { return proto.CompactTextString(m) }
+func (*PushAck) ProtoMessage()    {}
+
+// TailRequest asks to tail a single log, optionally starting mid-stream
+// and optionally following new writes as they arrive. EndOffset left at
+// its zero value (with Follow false) means "the stream's current end"
+// rather than "stop immediately".
+type TailRequest struct {
+	Id          string `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	StartOffset int64  `protobuf:"varint,2,opt,name=start_offset,json=startOffset,proto3" json:"start_offset,omitempty"`
+	EndOffset   int64  `protobuf:"varint,3,opt,name=end_offset,json=endOffset,proto3" json:"end_offset,omitempty"`
+	Follow      bool   `protobuf:"varint,4,opt,name=follow,proto3" json:"follow,omitempty"`
+}
+
+func (m *TailRequest) Reset()         { *m = TailRequest{} }
+func (m *TailRequest) String() string { return proto.CompactTextString(m) }
+func (*TailRequest) ProtoMessage()    {}
+
+func init() {
+	proto.RegisterType((*LogChunk)(nil), "livelog.LogChunk")
+	proto.RegisterType((*PushAck)(nil), "livelog.PushAck")
+	proto.RegisterType((*TailRequest)(nil), "livelog.TailRequest")
+}
+
+// LivelogClient is the client API for the Livelog service.
+type LivelogClient interface {
+	Push(ctx context.Context, opts ...grpc.CallOption) (Livelog_PushClient, error)
+	Tail(ctx context.Context, in *TailRequest, opts ...grpc.CallOption) (Livelog_TailClient, error)
+}
+
+type livelogClient struct {
+	cc *grpc.ClientConn
+}
+
+// NewLivelogClient returns a client for the Livelog service over cc.
+func NewLivelogClient(cc *grpc.ClientConn) LivelogClient {
+	return &livelogClient{cc}
+}
+
+func (c *livelogClient) Push(ctx context.Context, opts ...grpc.CallOption) (Livelog_PushClient, error) {
+	stream, err := c.cc.NewStream(ctx, &_Livelog_serviceDesc.Streams[0], "/livelog.Livelog/Push", opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &livelogPushClient{stream}, nil
+}
+
+type Livelog_PushClient interface {
+	Send(*LogChunk) error
+	CloseAndRecv() (*PushAck, error)
+	grpc.ClientStream
+}
+
+type livelogPushClient struct {
+	grpc.ClientStream
+}
+
+func (x *livelogPushClient) Send(m *LogChunk) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *livelogPushClient) CloseAndRecv() (*PushAck, error) {
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	ack := new(PushAck)
+	if err := x.ClientStream.RecvMsg(ack); err != nil {
+		return nil, err
+	}
+	return ack, nil
+}
+
+func (c *livelogClient) Tail(ctx context.Context, in *TailRequest, opts ...grpc.CallOption) (Livelog_TailClient, error) {
+	stream, err := c.cc.NewStream(ctx, &_Livelog_serviceDesc.Streams[1], "/livelog.Livelog/Tail", opts...)
+	if err != nil {
+		return nil, err
+	}
+	if err := stream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := stream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return &livelogTailClient{stream}, nil
+}
+
+type Livelog_TailClient interface {
+	Recv() (*LogChunk, error)
+	grpc.ClientStream
+}
+
+type livelogTailClient struct {
+	grpc.ClientStream
+}
+
+func (x *livelogTailClient) Recv() (*LogChunk, error) {
+	chunk := new(LogChunk)
+	if err := x.ClientStream.RecvMsg(chunk); err != nil {
+		return nil, err
+	}
+	return chunk, nil
+}
+
+// LivelogServer is the server API for the Livelog service.
+type LivelogServer interface {
+	Push(Livelog_PushServer) error
+	Tail(*TailRequest, Livelog_TailServer) error
+}
+
+// RegisterLivelogServer registers srv as the implementation backing s.
+func RegisterLivelogServer(s *grpc.Server, srv LivelogServer) {
+	s.RegisterService(&_Livelog_serviceDesc, srv)
+}
+
+func _Livelog_Push_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(LivelogServer).Push(&livelogPushServer{stream})
+}
+
+type Livelog_PushServer interface {
+	SendAndClose(*PushAck) error
+	Recv() (*LogChunk, error)
+	grpc.ServerStream
+}
+
+type livelogPushServer struct {
+	grpc.ServerStream
+}
+
+func (x *livelogPushServer) SendAndClose(ack *PushAck) error {
+	return x.ServerStream.SendMsg(ack)
+}
+
+func (x *livelogPushServer) Recv() (*LogChunk, error) {
+	chunk := new(LogChunk)
+	if err := x.ServerStream.RecvMsg(chunk); err != nil {
+		return nil, err
+	}
+	return chunk, nil
+}
+
+func _Livelog_Tail_Handler(srv interface{}, stream grpc.ServerStream) error {
+	req := new(TailRequest)
+	if err := stream.RecvMsg(req); err != nil {
+		return err
+	}
+	return srv.(LivelogServer).Tail(req, &livelogTailServer{stream})
+}
+
+type Livelog_TailServer interface {
+	Send(*LogChunk) error
+	grpc.ServerStream
+}
+
+type livelogTailServer struct {
+	grpc.ServerStream
+}
+
+func (x *livelogTailServer) Send(chunk *LogChunk) error {
+	return x.ServerStream.SendMsg(chunk)
+}
+
+var _Livelog_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "livelog.Livelog",
+	HandlerType: (*LivelogServer)(nil),
+	Methods:     []grpc.MethodDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Push",
+			Handler:       _Livelog_Push_Handler,
+			ClientStreams: true,
+		},
+		{
+			StreamName:    "Tail",
+			Handler:       _Livelog_Tail_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "livelog.proto",
+}
@@ -0,0 +1,177 @@
+package grpc
+
+import (
+	"context"
+	"io"
+
+	stream "github.com/taskcluster/livelog/writer"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Registry is the subset of streamRegistry's behavior the gRPC server
+// needs in order to share the same backing streams as the HTTP PUT/GET
+// handlers.
+type Registry interface {
+	Get(id string) (*stream.Stream, bool)
+	Register(id string, s *stream.Stream)
+	RegisterIfAbsent(id string, s *stream.Stream) bool
+	Unregister(id string)
+}
+
+// Server implements LivelogServer on top of the same stream.Stream
+// backend used by the HTTP handlers, so a log can be produced or tailed
+// over whichever transport a client prefers.
+type Server struct {
+	registry    Registry
+	accessToken string
+}
+
+// NewServer returns a Server backed by registry, authenticating RPCs
+// against accessToken via the "access-token" request metadata. An empty
+// accessToken disables authentication, matching the HTTP side's behavior
+// when ACCESS_TOKEN is unset.
+func NewServer(registry Registry, accessToken string) *Server {
+	return &Server{registry: registry, accessToken: accessToken}
+}
+
+// authorize checks the incoming RPC's "access-token" metadata against
+// accessToken, the gRPC equivalent of the HTTP side's
+// /log/<id>/<accessToken> path check. An empty accessToken (ACCESS_TOKEN
+// unset) disables the check entirely.
+func authorize(ctx context.Context, accessToken string) error {
+	if accessToken == "" {
+		return nil
+	}
+
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return status.Error(codes.Unauthenticated, "missing access-token metadata")
+	}
+
+	values := md.Get("access-token")
+	if len(values) != 1 || values[0] != accessToken {
+		return status.Error(codes.Unauthenticated, "invalid access-token metadata")
+	}
+
+	return nil
+}
+
+// chunkReader adapts a Push stream's Recv calls into an io.Reader so the
+// chunks can be fed straight into stream.NewStream, the same entry point
+// the HTTP PUT handler uses.
+type chunkReader struct {
+	recv func() (*LogChunk, error)
+	buf  []byte
+	read int64
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		chunk, err := r.recv()
+		if err != nil {
+			return 0, err
+		}
+		r.buf = chunk.Data
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	r.read += int64(n)
+	return n, nil
+}
+
+// Push implements the producer side of the service: the first LogChunk
+// in the stream names the log via Id, and its Data and that of every
+// chunk after it are appended to the log.
+func (s *Server) Push(srv Livelog_PushServer) error {
+	if err := authorize(srv.Context(), s.accessToken); err != nil {
+		return err
+	}
+
+	first, err := srv.Recv()
+	if err != nil {
+		return status.Errorf(codes.Internal, "could not read first chunk: %v", err)
+	}
+	if first.Id == "" {
+		return status.Error(codes.InvalidArgument, "first chunk must set id")
+	}
+
+	reader := &chunkReader{recv: srv.Recv, buf: first.Data}
+
+	st, streamErr := stream.NewStream(reader)
+	if streamErr != nil {
+		return status.Errorf(codes.Internal, "could not open stream: %v", streamErr)
+	}
+
+	// Register and the "already in progress" check must be atomic, the
+	// same TOCTOU the HTTP PUT handler closed with RegisterIfAbsent: a
+	// separate Get followed by Register would let two concurrent
+	// producers for the same id (two Pushes, or a Push racing a PUT)
+	// both register, with the second clobbering the first.
+	if !s.registry.RegisterIfAbsent(first.Id, st) {
+		return status.Errorf(codes.AlreadyExists, "log id %q is already being produced", first.Id)
+	}
+	defer s.registry.Unregister(first.Id)
+
+	if consumeErr := st.Consume(); consumeErr != nil && consumeErr != io.EOF {
+		return status.Errorf(codes.Internal, "consume failed: %v", consumeErr)
+	}
+
+	return srv.SendAndClose(&PushAck{BytesReceived: reader.read})
+}
+
+// chunkWriter adapts the chunk-at-a-time writes coming out of
+// Handle.WriteTo into Tail response messages, stamping each one with the
+// stream offset it starts at so a client can track position or resume a
+// later Tail with start_offset.
+type chunkWriter struct {
+	send   func(*LogChunk) error
+	id     string
+	handle *stream.Handle
+}
+
+func (w *chunkWriter) Write(p []byte) (int, error) {
+	data := make([]byte, len(p))
+	copy(data, p)
+	// The handle's position is where this chunk starts, including any
+	// bytes skipped by a drop-forward.
+	if err := w.send(&LogChunk{Id: w.id, Data: data, Offset: w.handle.Position()}); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Tail implements the consumer side of the service, mapping start_offset,
+// end_offset and follow onto stream.Observe's start/stop offsets exactly
+// as the HTTP GET handler does with its Range header.
+func (s *Server) Tail(req *TailRequest, srv Livelog_TailServer) error {
+	if err := authorize(srv.Context(), s.accessToken); err != nil {
+		return err
+	}
+
+	st, ok := s.registry.Get(req.Id)
+	if !ok {
+		return status.Errorf(codes.NotFound, "unknown log id %q", req.Id)
+	}
+
+	stop := req.EndOffset
+	switch {
+	case stop > 0:
+		// An explicit end_offset bounds the tail, following or not.
+	case req.Follow:
+		stop = -1
+	default:
+		// end_offset defaults to 0 on the wire, which would otherwise
+		// read as "stop immediately" and hand back an empty stream for
+		// a plain, non-following tail. Treat the zero value as "to the
+		// stream's current end" instead.
+		stop = st.Length()
+	}
+
+	handle := st.Observe(req.StartOffset, stop)
+	defer st.Unobserve(handle)
+
+	_, err := handle.WriteTo(&chunkWriter{send: srv.Send, id: req.Id, handle: handle})
+	return err
+}
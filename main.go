@@ -1,20 +1,31 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"fmt"
+	"io"
 	"log"
+	"net"
 	"net/http"
 	"net/http/pprof"
 	"os"
 	"strconv"
+	"strings"
 	"sync"
+	"time"
 
+	"github.com/gorilla/websocket"
+	livelogGRPC "github.com/taskcluster/livelog/grpc"
 	stream "github.com/taskcluster/livelog/writer"
 	. "github.com/visionmedia/go-debug"
+	"google.golang.org/grpc"
 )
 
 var debug = Debug("livelog")
 
+var crlf = []byte("\r\n")
+
 const (
 	DEFAULT_PUT_PORT = 60022
 	DEFAULT_GET_PORT = 60023
@@ -34,7 +45,134 @@ func abort(writer http.ResponseWriter) error {
 	return nil
 }
 
-func startLogServe(stream *stream.Stream, getAddr string) {
+// hijackStatusLine writes a minimal HTTP/1.1 status line directly onto a
+// hijacked connection, declaring a chunked body with a trailing
+// X-Livelog-Status header. Writing the status line by hand (rather than
+// through http.ResponseWriter) is what lets us keep the connection open
+// and report a terminal error via the trailer once the body is already
+// underway, instead of slamming the connection closed like abort does.
+func hijackStatusLine(bufrw *bufio.ReadWriter, status int, statusText string, headers http.Header, trailers ...string) error {
+	fmt.Fprintf(bufrw, "HTTP/1.1 %d %s\r\n", status, statusText)
+	fmt.Fprintf(bufrw, "Transfer-Encoding: chunked\r\n")
+	fmt.Fprintf(bufrw, "Trailer: %s\r\n", strings.Join(append([]string{"X-Livelog-Status"}, trailers...), ", "))
+	for name, values := range headers {
+		for _, value := range values {
+			fmt.Fprintf(bufrw, "%s: %s\r\n", name, value)
+		}
+	}
+	fmt.Fprintf(bufrw, "\r\n")
+	return bufrw.Flush()
+}
+
+// writeChunk writes p as a single HTTP/1.1 chunked-encoding chunk.
+func writeChunk(bufrw *bufio.ReadWriter, p []byte) error {
+	if _, err := fmt.Fprintf(bufrw, "%x\r\n", len(p)); err != nil {
+		return err
+	}
+	if _, err := bufrw.Write(p); err != nil {
+		return err
+	}
+	if _, err := bufrw.Write(crlf); err != nil {
+		return err
+	}
+	return bufrw.Flush()
+}
+
+// writeTrailerAndClose terminates a chunked body written via
+// hijackStatusLine/writeChunk, reporting err (if any) through the
+// X-Livelog-Status trailer, plus any extra trailers (e.g.
+// X-Livelog-Skipped-Bytes), before closing the connection. This is the
+// only way left to surface a failure once the status line has already
+// gone out.
+func writeTrailerAndClose(conn net.Conn, bufrw *bufio.ReadWriter, err error, extra map[string]string) {
+	status := "ok"
+	if err != nil {
+		status = err.Error()
+	}
+	fmt.Fprintf(bufrw, "0\r\nX-Livelog-Status: %s\r\n", status)
+	for name, value := range extra {
+		fmt.Fprintf(bufrw, "%s: %s\r\n", name, value)
+	}
+	fmt.Fprintf(bufrw, "\r\n")
+	bufrw.Flush()
+	conn.Close()
+}
+
+// streamRegistry keeps track of the streams currently being produced,
+// keyed by log ID, so a single livelog process can host many concurrent
+// task logs instead of one-process-per-task.
+type streamRegistry struct {
+	mutex   sync.Mutex
+	streams map[string]*stream.Stream
+}
+
+func newStreamRegistry() *streamRegistry {
+	return &streamRegistry{streams: make(map[string]*stream.Stream)}
+}
+
+// defaultRetainSeconds is how long a finished stream stays registered
+// (and therefore GET/HEAD-able) after its producer finishes, when
+// LIVELOG_RETAIN_SECONDS isn't set.
+const defaultRetainSeconds = 300
+
+// retainDuration returns how long a finished log should stay registered
+// before it's deregistered, from LIVELOG_RETAIN_SECONDS if set and
+// valid, otherwise defaultRetainSeconds.
+func retainDuration() time.Duration {
+	if v := os.Getenv("LIVELOG_RETAIN_SECONDS"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n >= 0 {
+			return time.Duration(n) * time.Second
+		}
+		debug("ignoring invalid LIVELOG_RETAIN_SECONDS %q", v)
+	}
+	return defaultRetainSeconds * time.Second
+}
+
+func (r *streamRegistry) Register(id string, s *stream.Stream) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.streams[id] = s
+}
+
+func (r *streamRegistry) Unregister(id string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	delete(r.streams, id)
+}
+
+func (r *streamRegistry) Get(id string) (*stream.Stream, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	s, ok := r.streams[id]
+	return s, ok
+}
+
+// RegisterIfAbsent registers s under id and returns true, unless a stream
+// is already registered under id, in which case it leaves the registry
+// untouched and returns false. This is the atomic check-and-register a
+// caller needs to reject a second concurrent PUT for the same id without
+// racing a separate Get against this Register.
+func (r *streamRegistry) RegisterIfAbsent(id string, s *stream.Stream) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if _, inProgress := r.streams[id]; inProgress {
+		return false
+	}
+	r.streams[id] = s
+	return true
+}
+
+// splitLogPath splits the "/log/<id>/..." suffix of a request URL into the
+// log ID and whatever remains after it (e.g. the access token).
+func splitLogPath(path string) (id string, rest string) {
+	path = path[len("/log/"):]
+	if idx := strings.Index(path, "/"); idx >= 0 {
+		return path[:idx], path[idx+1:]
+	}
+	return path, ""
+}
+
+func startLogServe(registry *streamRegistry, getAddr string) {
 	// Get access token from environment variable
 	accessToken := os.Getenv("ACCESS_TOKEN")
 
@@ -42,15 +180,29 @@ func startLogServe(stream *stream.Stream, getAddr string) {
 	routes.HandleFunc("/log/", func(w http.ResponseWriter, r *http.Request) {
 		debug("output %s %s", r.Method, r.URL.String())
 
+		id, accessTokenGiven := splitLogPath(r.URL.Path)
+
 		// Authenticate the request with accessToken, this is good enough because
-		// live logs are short-lived, we do this by slicing away '/log/' from the
-		// URL and comparing the reminder to the accessToken, ensuring a URL pattern
-		// /log/<accessToken>
-		if r.URL.String()[5:] != accessToken {
+		// live logs are short-lived, ensuring a URL pattern /log/<id>/<accessToken>.
+		// Check this before looking the id up in the registry, so a
+		// missing log and a wrong access token both come back as 401 —
+		// otherwise the 404/401 split lets an unauthenticated client
+		// enumerate which log ids exist.
+		if accessTokenGiven != accessToken {
 			writeHeaders(w, r)
 			w.WriteHeader(401)
 			fmt.Fprint(w, "Access denied")
-		} else if r.Method == "HEAD" {
+			return
+		}
+
+		s, ok := registry.Get(id)
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, "Unknown log id")
+			return
+		}
+
+		if r.Method == "HEAD" {
 			writeHeaders(w, r)
 			// If we are creating a HEAD request, we can also mark that the subsequent
 			// GET request exposes access to X-Streaming
@@ -58,7 +210,7 @@ func startLogServe(stream *stream.Stream, getAddr string) {
 			w.WriteHeader(200)
 			debug("Sending HEAD request headers")
 		} else {
-			getLog(stream, w, r)
+			getLog(s, w, r)
 		}
 	})
 
@@ -80,6 +232,23 @@ func startLogServe(stream *stream.Stream, getAddr string) {
 	}
 }
 
+// startGRPCServe starts the gRPC Push/Tail service on port, sharing
+// registry with the HTTP PUT/GET servers and reusing the same
+// ACCESS_TOKEN check via per-RPC metadata instead of the URL path.
+func startGRPCServe(registry *streamRegistry, port string) {
+	lis, err := net.Listen("tcp", ":"+port)
+	if err != nil {
+		log.Println("Error starting gRPC listener...", err)
+		return
+	}
+
+	grpcServer := grpc.NewServer()
+	livelogGRPC.RegisterLivelogServer(grpcServer, livelogGRPC.NewServer(registry, os.Getenv("ACCESS_TOKEN")))
+
+	debug("gRPC server listening... :%s", port)
+	grpcServer.Serve(lis)
+}
+
 func writeHeaders(
 	writer http.ResponseWriter,
 	req *http.Request,
@@ -94,7 +263,16 @@ func writeHeaders(
 	log.Printf("%v", req.Header)
 }
 
-// HTTP logic for serving the contents of a stream...
+var upgrader = websocket.Upgrader{
+	// Live logs are read-only from the browser's perspective, so we don't
+	// need to worry about the usual CSRF concerns around cross-origin
+	// upgrades.
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// HTTP logic for serving the contents of a stream, negotiating between a
+// WebSocket, Server-Sent Events, or the original raw streaming output
+// based on the incoming request.
 func getLog(
 	stream *stream.Stream,
 	writer http.ResponseWriter,
@@ -109,28 +287,228 @@ func getLog(
 		return
 	}
 
+	if lastEventID := req.Header.Get("Last-Event-ID"); lastEventID != "" {
+		if offset, err := strconv.ParseInt(lastEventID, 10, 64); err == nil {
+			rng.Start = offset
+		} else {
+			debug("ignoring unparsable Last-Event-ID %q", lastEventID)
+		}
+	}
+
+	switch {
+	case strings.ToLower(req.Header.Get("Upgrade")) == "websocket":
+		serveLogWebSocket(stream, rng, writer, req)
+	case strings.Contains(req.Header.Get("Accept"), "text/event-stream"):
+		serveLogSSE(stream, rng, writer, req)
+	default:
+		serveLogRaw(stream, rng, writer, req)
+	}
+}
+
+// serveLogRaw is the original streaming output path: a plain HTTP response
+// body that the stream is copied into as it arrives.
+//
+// Unlike the old implementation, we don't commit to a 200 until
+// stream.Observe has produced its first bytes (or failed), and we hijack
+// the connection ourselves so a write error discovered mid-stream can be
+// reported through the X-Livelog-Status trailer instead of the client
+// only seeing a slammed-shut connection.
+func serveLogRaw(
+	stream *stream.Stream,
+	rng Range,
+	writer http.ResponseWriter,
+	req *http.Request,
+) {
 	handle := stream.Observe(rng.Start, rng.Stop)
+	defer stream.Unobserve(handle)
+
+	hw := &hijackOnFirstWrite{writer: writer}
+	_, writeToErr := handle.WriteTo(hw)
+
+	if !hw.hijacked {
+		// Nothing was ever written (e.g. an empty, already-finished log, or
+		// a producer that failed before its first byte); we still need to
+		// hijack so the trailer can report the final status.
+		if err := hw.doHijack(); err != nil {
+			log.Println("Error hijacking connection...", err)
+			return
+		}
+	}
 
-	defer func() {
-		// Ensure we close our file handle...
-		// Ensure the stream is cleaned up after errors, etc...
-		stream.Unobserve(handle)
-		debug("send connection close...")
-	}()
+	debug("send connection close...")
 
-	// Send headers so its clear what we are trying to do...
-	writeHeaders(writer, req)
+	var extra map[string]string
+	if skipped := handle.Skipped(); skipped > 0 {
+		extra = map[string]string{"X-Livelog-Skipped-Bytes": strconv.FormatInt(skipped, 10)}
+	}
+	writeTrailerAndClose(hw.conn, hw.bufrw, writeToErr, extra)
+}
+
+// hijackOnFirstWrite defers hijacking writer until the first byte of the
+// stream is actually ready to go out, so that stream.Observe failing fast
+// never leaves a half-committed 200 response behind.
+type hijackOnFirstWrite struct {
+	writer   http.ResponseWriter
+	conn     net.Conn
+	bufrw    *bufio.ReadWriter
+	hijacked bool
+}
+
+func (h *hijackOnFirstWrite) doHijack() error {
+	conn, bufrw, err := h.writer.(http.Hijacker).Hijack()
+	if err != nil {
+		return err
+	}
+	h.conn, h.bufrw, h.hijacked = conn, bufrw, true
+
+	debug("hijacked connection, writing headers...")
+	return hijackStatusLine(bufrw, 200, "OK", http.Header{
+		"Content-Type":                  {"text/plain; charset=utf-8"},
+		"Access-Control-Allow-Origin":   {"*"},
+		"X-Streaming":                   {"true"},
+		"Access-Control-Expose-Headers": {"X-Streaming"},
+	}, "X-Livelog-Skipped-Bytes")
+}
+
+func (h *hijackOnFirstWrite) Write(p []byte) (int, error) {
+	if !h.hijacked {
+		if err := h.doHijack(); err != nil {
+			return 0, err
+		}
+	}
+	if err := writeChunk(h.bufrw, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// sseWriter adapts the chunk-at-a-time writes coming out of Handle.WriteTo
+// into Server-Sent Events "data:" frames, with an "id:" set to the byte
+// offset reached so far so that clients can resume via Last-Event-ID.
+type sseWriter struct {
+	w      io.Writer
+	handle *stream.Handle
+}
+
+func (s *sseWriter) Write(p []byte) (int, error) {
+	// The handle's position is where this chunk starts; reading it here
+	// (rather than counting from the requested start) accounts for Observe
+	// clamping the start and for bytes skipped by a drop-forward.
+	offset := s.handle.Position() + int64(len(p))
+
+	// Log chunks routinely contain embedded newlines, and per the SSE
+	// grammar each one starts a new line that must carry its own "data:"
+	// prefix or it's parsed as a different, ignored field. Emit one
+	// data: line per line of the chunk instead of dumping it raw.
+	lines := strings.Split(string(p), "\n")
+	if len(lines) > 0 && lines[len(lines)-1] == "" {
+		// A trailing "\n" produces a spurious empty final element; drop
+		// it so we don't emit a blank data: line for it.
+		lines = lines[:len(lines)-1]
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "id: %d\n", offset)
+	for _, line := range lines {
+		fmt.Fprintf(&buf, "data: %s\n", line)
+	}
+	buf.WriteString("\n")
+
+	if _, err := s.w.Write(buf.Bytes()); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// serveLogSSE streams the log as Server-Sent Events, one "data:" frame per
+// buffered chunk, so browsers can live-tail via EventSource instead of
+// polling HEAD/GET.
+func serveLogSSE(
+	stream *stream.Stream,
+	rng Range,
+	writer http.ResponseWriter,
+	req *http.Request,
+) {
+	handle := stream.Observe(rng.Start, rng.Stop)
+	defer stream.Unobserve(handle)
+
+	writer.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+	writer.Header().Set("Cache-Control", "no-cache")
+	writer.Header().Set("Access-Control-Allow-Origin", "*")
 	writer.WriteHeader(200)
-	debug("wrote headers...")
 
-	// Begin streaming any pending results...
-	_, writeToErr := handle.WriteTo(writer)
+	flusher, canFlush := writer.(http.Flusher)
+
+	sw := &sseWriter{w: writer, handle: handle}
+	_, writeToErr := handle.WriteTo(flushingWriter{sw, flusher, canFlush})
 	if writeToErr != nil {
-		log.Println("Error during write...", writeToErr)
+		log.Println("Error during SSE write...", writeToErr)
 		abort(writer)
 	}
 }
 
+// flushingWriter flushes after every underlying Write, since SSE frames
+// must reach the client as soon as they're produced rather than sitting in
+// a buffer.
+type flushingWriter struct {
+	w        io.Writer
+	flusher  http.Flusher
+	canFlush bool
+}
+
+func (f flushingWriter) Write(p []byte) (int, error) {
+	n, err := f.w.Write(p)
+	if f.canFlush {
+		f.flusher.Flush()
+	}
+	return n, err
+}
+
+// serveLogWebSocket upgrades the connection and pushes binary frames from
+// the stream handle, closing the socket once the stream finishes.
+func serveLogWebSocket(
+	stream *stream.Stream,
+	rng Range,
+	writer http.ResponseWriter,
+	req *http.Request,
+) {
+	conn, err := upgrader.Upgrade(writer, req, nil)
+	if err != nil {
+		log.Println("Error upgrading to websocket...", err)
+		return
+	}
+	defer conn.Close()
+
+	handle := stream.Observe(rng.Start, rng.Stop)
+	defer stream.Unobserve(handle)
+
+	_, writeToErr := handle.WriteTo(websocketWriter{conn})
+	if writeToErr != nil {
+		log.Println("Error during websocket write...", writeToErr)
+		conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseInternalServerErr, writeToErr.Error()),
+			time.Now().Add(time.Second))
+		return
+	}
+
+	conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+		time.Now().Add(time.Second))
+}
+
+// websocketWriter adapts the chunk-at-a-time writes coming out of
+// Handle.WriteTo into binary websocket frames.
+type websocketWriter struct {
+	conn *websocket.Conn
+}
+
+func (w websocketWriter) Write(p []byte) (int, error) {
+	if err := w.conn.WriteMessage(websocket.BinaryMessage, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
 // Logic here mostly inspired by what docker does...
 func attachProfiler(router *http.ServeMux) {
 	router.HandleFunc("/debug/pprof/", pprof.Index)
@@ -143,14 +521,7 @@ func attachProfiler(router *http.ServeMux) {
 }
 
 func main() {
-	// TODO: Right now this is a collection of hacks until we build out something
-	// nice which can handle multiple log connections. Right now the intent is to
-	// use this as a process per task (which has overhead) but should be fairly
-	// clean (memory wise) in the long run as we will terminate the process
-	// frequently per task run.
-
-	handlingPut := false
-	mutex := sync.Mutex{}
+	registry := newStreamRegistry()
 
 	routes := http.NewServeMux()
 
@@ -182,6 +553,14 @@ func main() {
 	putAddr := portAddressOrExit("LIVELOG_PUT_PORT", DEFAULT_PUT_PORT, 64, 65)
 	getAddr := portAddressOrExit("LIVELOG_GET_PORT", DEFAULT_GET_PORT, 66, 67)
 
+	// The gRPC side is optional: it shares the same registry as the HTTP
+	// servers, so a log can be produced or tailed over whichever transport
+	// a client prefers, without the per-connection hijack dance the HTTP
+	// side needs.
+	if grpcPort := os.Getenv("LIVELOG_GRPC_PORT"); grpcPort != "" {
+		go startGRPCServe(registry, grpcPort)
+	}
+
 	server := http.Server{
 		// Main put server listens on the public root for the worker.
 		Addr:    putAddr,
@@ -191,7 +570,7 @@ func main() {
 	// The "main" http server is for the PUT side which should not be exposed
 	// publicly but via links in the docker container... In the future we can
 	// handle something fancier.
-	routes.HandleFunc("/log", func(w http.ResponseWriter, r *http.Request) {
+	routes.HandleFunc("/log/", func(w http.ResponseWriter, r *http.Request) {
 		debug("input %s %s", r.Method, r.URL.String())
 
 		if r.Method != "PUT" {
@@ -201,44 +580,64 @@ func main() {
 			return
 		}
 
-		// Threadsafe checking of the `handlingPut` flag
-		mutex.Lock()
-		if handlingPut {
-			debug("Attempt to put when in progress")
+		id, _ := splitLogPath(r.URL.Path)
+		if id == "" {
 			w.WriteHeader(http.StatusBadRequest)
-			w.Write([]byte("This endpoint can only process one http PUT at a time"))
-			mutex.Unlock() // used instead of defer so we don't block other rejections
+			w.Write([]byte("Missing log id"))
 			return
 		}
-		mutex.Unlock() // So we don't block other rejections...
 
-		stream, streamErr := stream.NewStream(r.Body)
+		s, streamErr := stream.NewStream(r.Body)
 
 		if streamErr != nil {
 			debug("input stream open err", streamErr)
 			w.WriteHeader(http.StatusInternalServerError)
 			w.Write([]byte("Could not open stream for body"))
+			return
+		}
 
-			// Allow for retries of the initial put if something goes wrong...
-			mutex.Lock()
-			handlingPut = false
-			mutex.Unlock()
+		// Register and the "already in progress" check must be atomic: a
+		// separate Get followed by Register would let two concurrent PUTs
+		// for the same id both pass the check and the second clobber the
+		// first's registration.
+		if !registry.RegisterIfAbsent(id, s) {
+			debug("Attempt to put %s when already in progress", id)
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("This log id is already being produced"))
+			return
 		}
 
-		// Signal initial success...
+		// Signal initial success, but announce X-Livelog-Status as a
+		// trailer so a Consume failure further down can still be
+		// reported after the 201 has gone out. We deliberately don't
+		// hijack here: the stream already reads directly from r.Body,
+		// and net/http forbids using Body once the connection is
+		// hijacked out from under it.
+		w.Header().Set("Trailer", "X-Livelog-Status")
 		w.WriteHeader(http.StatusCreated)
 
-		// Initialize the sub server in another go routine...
-		debug("Begin consuming...")
-		go startLogServe(stream, getAddr)
-		consumeErr := stream.Consume()
+		debug("Begin consuming %s...", id)
+		consumeErr := s.Consume()
+
+		// Keep the finished log registered (and so GET/HEAD-able) for a
+		// grace period rather than deregistering it the instant the
+		// producer hits EOF — callers routinely read back a task's log
+		// after it completes, and an immediate Unregister here would
+		// 404 any of those.
+		time.AfterFunc(retainDuration(), func() { registry.Unregister(id) })
+
+		status := "ok"
 		if consumeErr != nil {
 			log.Println("Error finalizing consume of stream", consumeErr)
-			abort(w)
-			return
+			status = consumeErr.Error()
 		}
+		w.Header().Set("X-Livelog-Status", status)
 	})
 
+	// The GET side serves whatever streams are currently registered, and can
+	// host many concurrent task logs at once.
+	go startLogServe(registry, getAddr)
+
 	// Listen forever on the PUT side...
 	debug("input server listening... %s", server.Addr)
 	server.ListenAndServe()
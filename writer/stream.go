@@ -0,0 +1,402 @@
+// Package writer implements the bounded, multi-reader log stream backing
+// the livelog PUT/GET handlers. A Stream accepts a single producer (the
+// PUT body) and fans it out to any number of concurrent observers (GET
+// requests), each of which may be tailing from a different offset and at
+// a different pace.
+//
+// Rather than spooling the whole log to disk, bytes are kept in a fixed
+// size ring buffer (LIVELOG_BUFFER_BYTES) so memory use is bounded
+// regardless of log size or how many slow observers pile up. Each
+// observer gets its own flow-control window estimating how far it's
+// allowed to lag before it gets dropped forward rather than stalling the
+// producer — see Stream.makeRoom.
+package writer
+
+import (
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	. "github.com/visionmedia/go-debug"
+)
+
+var debug = Debug("livelog:writer")
+
+const (
+	// defaultBufferBytes is used when LIVELOG_BUFFER_BYTES isn't set.
+	defaultBufferBytes = 4 << 20 // 4 MiB
+
+	// minWindowBytes is the smallest flow-control window an observer can
+	// shrink to; below this, every write would force a drop-forward.
+	minWindowBytes = 64 << 10 // 64 KiB
+
+	// windowSampleInterval throttles how often an observer's window is
+	// grown or shrunk, so a burst of small writes doesn't thrash it.
+	windowSampleInterval = 250 * time.Millisecond
+)
+
+// bufferCapacity returns the configured ring buffer size, from
+// LIVELOG_BUFFER_BYTES if set and valid, otherwise defaultBufferBytes.
+func bufferCapacity() int64 {
+	if v := os.Getenv("LIVELOG_BUFFER_BYTES"); v != "" {
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil && n > 0 {
+			return n
+		}
+		debug("ignoring invalid LIVELOG_BUFFER_BYTES %q", v)
+	}
+	return defaultBufferBytes
+}
+
+// observerState is a Handle's share of the producer-side bookkeeping:
+// where it's currently read up to, and the flow-control window bounding
+// how far the producer may get ahead of it before dropping it forward.
+type observerState struct {
+	position int64 // next unread absolute byte offset
+	window   int64 // max bytes the producer may lead this observer by
+	skipped  int64 // bytes this observer was forcibly advanced past
+
+	lastSampledPosition int64
+	lastSampledAt       time.Time
+}
+
+// Stream consumes a single producer body into a bounded ring buffer so
+// that any number of Handles can tail it concurrently, regardless of how
+// far behind the producer any individual one is.
+type Stream struct {
+	body     io.Reader
+	capacity int64
+	buf      []byte
+
+	mutex   sync.Mutex
+	cond    *sync.Cond
+	base    int64 // absolute offset of the oldest retained byte
+	length  int64 // absolute offset one past the last written byte
+	done    bool
+	err     error
+	handles map[*Handle]*observerState
+}
+
+// NewStream wraps body so it can be Consume()d while being observed by
+// any number of Handles, buffering at most bufferCapacity() bytes at a
+// time.
+func NewStream(body io.Reader) (*Stream, error) {
+	capacity := bufferCapacity()
+
+	s := &Stream{
+		body:     body,
+		capacity: capacity,
+		buf:      make([]byte, capacity),
+		handles:  make(map[*Handle]*observerState),
+	}
+	s.cond = sync.NewCond(&s.mutex)
+
+	return s, nil
+}
+
+// Consume reads the producer body to completion, writing it into the
+// ring buffer and waking any waiting observers as new bytes become
+// available. It blocks until the body is exhausted (or errors).
+func (s *Stream) Consume() error {
+	defer func() {
+		s.mutex.Lock()
+		s.done = true
+		s.mutex.Unlock()
+		s.cond.Broadcast()
+	}()
+
+	buf := make([]byte, 32*1024)
+	for {
+		n, readErr := s.body.Read(buf)
+		if n > 0 {
+			s.write(buf[:n])
+		}
+
+		if readErr != nil {
+			if readErr == io.EOF {
+				return nil
+			}
+			s.mutex.Lock()
+			s.err = readErr
+			s.mutex.Unlock()
+			return readErr
+		}
+	}
+}
+
+// write appends p to the ring buffer, evicting the oldest retained bytes
+// (via makeRoom) as needed to make space once the buffer is full.
+func (s *Stream) write(p []byte) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for len(p) > 0 {
+		n := int64(len(p))
+		if n > s.capacity {
+			n = s.capacity
+		}
+
+		for s.capacity-(s.length-s.base) < n {
+			s.makeRoom(n - (s.capacity - (s.length - s.base)))
+		}
+
+		s.writeRing(s.length, p[:n])
+		s.length += n
+		p = p[n:]
+		s.cond.Broadcast()
+	}
+}
+
+// makeRoom evicts at least `need` of the oldest retained bytes, called
+// with s.mutex held. An observer still reading from within the bytes
+// about to be evicted blocks the producer only while it's inside its own
+// flow-control window; once it falls further behind than that, it's
+// dropped forward to the new base instead, so one slow observer can
+// never stall every other consumer.
+func (s *Stream) makeRoom(need int64) {
+	for {
+		evictable := need
+		var blockedBy *observerState
+
+		for _, st := range s.handles {
+			if st.position > s.base+evictable {
+				continue // not in the way of evicting `evictable` bytes
+			}
+
+			s.sampleWindow(st)
+
+			if s.length-st.position > st.window {
+				newPos := s.base + evictable
+				if newPos > st.position {
+					st.skipped += newPos - st.position
+					st.position = newPos
+				}
+				continue
+			}
+
+			if allowed := st.position - s.base; allowed < evictable {
+				evictable = allowed
+			}
+			blockedBy = st
+		}
+
+		if evictable > 0 {
+			s.base += evictable
+			return
+		}
+
+		if blockedBy == nil {
+			// No observers left in the way (or none at all).
+			return
+		}
+
+		debug("producer waiting on observer with window %d bytes...", blockedBy.window)
+		s.cond.Wait()
+	}
+}
+
+// sampleWindow grows or shrinks an observer's flow-control window based
+// on whether it's making progress: steady progress against a saturated
+// window grows it (a fast observer gets more slack so its own pace stops
+// forcing the producer to wait on it), while no progress at all shrinks
+// it back down, so a stalled observer is dropped forward sooner rather
+// than holding a large reservation it isn't using.
+func (s *Stream) sampleWindow(st *observerState) {
+	now := time.Now()
+	if now.Sub(st.lastSampledAt) < windowSampleInterval {
+		return
+	}
+
+	advanced := st.position - st.lastSampledPosition
+	lag := s.length - st.position
+
+	switch {
+	case advanced > 0 && lag >= st.window:
+		if grown := st.window * 2; grown <= s.capacity {
+			st.window = grown
+		} else {
+			st.window = s.capacity
+		}
+	case advanced == 0:
+		if shrunk := st.window / 2; shrunk >= minWindowBytes {
+			st.window = shrunk
+		} else {
+			st.window = minWindowBytes
+		}
+	}
+
+	st.lastSampledPosition = st.position
+	st.lastSampledAt = now
+}
+
+// writeRing copies p into the ring storage starting at absolute offset.
+func (s *Stream) writeRing(offset int64, p []byte) {
+	for len(p) > 0 {
+		idx := offset % s.capacity
+		n := int64(len(p))
+		if n > s.capacity-idx {
+			n = s.capacity - idx
+		}
+		copy(s.buf[idx:idx+n], p[:n])
+		offset += n
+		p = p[n:]
+	}
+}
+
+// readRing copies from the ring storage starting at absolute offset into
+// buf. The caller must hold s.mutex and ensure offset >= s.base.
+func (s *Stream) readRing(offset int64, buf []byte) {
+	for len(buf) > 0 {
+		idx := offset % s.capacity
+		n := int64(len(buf))
+		if n > s.capacity-idx {
+			n = s.capacity - idx
+		}
+		copy(buf[:n], s.buf[idx:idx+n])
+		offset += n
+		buf = buf[n:]
+	}
+}
+
+// Observe returns a Handle that tails the stream starting at start. If
+// stop is >= 0 the handle stops once that offset has been written,
+// otherwise it follows the stream until the producer finishes. If start
+// has already fallen out of the retained window, it's clamped up to the
+// oldest byte still available.
+func (s *Stream) Observe(start, stop int64) *Handle {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if start < s.base {
+		start = s.base
+	}
+
+	now := time.Now()
+	state := &observerState{
+		position:            start,
+		window:              minWindowBytes,
+		lastSampledPosition: start,
+		lastSampledAt:       now,
+	}
+
+	h := &Handle{stream: s, state: state, stop: stop}
+	s.handles[h] = state
+	return h
+}
+
+// Unobserve releases handle, so it no longer counts against the
+// producer's flow control.
+func (s *Stream) Unobserve(handle *Handle) {
+	s.mutex.Lock()
+	delete(s.handles, handle)
+	s.mutex.Unlock()
+	s.cond.Broadcast()
+}
+
+// Length reports how many bytes have been written to the stream so far,
+// i.e. the absolute offset one past the last byte a new Observe call
+// would be able to read without following the producer.
+func (s *Stream) Length() int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.length
+}
+
+// Handle represents a single observer's view of a Stream, positioned at
+// a particular byte offset.
+type Handle struct {
+	stream *Stream
+	state  *observerState
+	stop   int64
+}
+
+// Skipped reports how many bytes this handle was forcibly advanced past
+// because it lagged further behind the producer than its flow-control
+// window allowed.
+func (h *Handle) Skipped() int64 {
+	h.stream.mutex.Lock()
+	defer h.stream.mutex.Unlock()
+	return h.state.skipped
+}
+
+// Position reports the absolute offset of the next byte this handle will
+// read. Immediately after Observe this is the requested start offset
+// clamped up to the oldest byte still retained, which can differ from
+// what was asked for if it had already fallen out of the buffer.
+func (h *Handle) Position() int64 {
+	h.stream.mutex.Lock()
+	defer h.stream.mutex.Unlock()
+	return h.state.position
+}
+
+// WriteTo copies bytes from the handle's current offset to w, following
+// the producer (blocking for more data) until either the handle's stop
+// offset is reached or the stream finishes. Bytes evicted out from under
+// a lagging handle are skipped rather than returned as an error; callers
+// that care can check Skipped afterwards.
+func (h *Handle) WriteTo(w io.Writer) (int64, error) {
+	s := h.stream
+	st := h.state
+	var written int64
+	buf := make([]byte, 32*1024)
+
+	for {
+		s.mutex.Lock()
+		if h.stop >= 0 && st.position >= h.stop {
+			s.mutex.Unlock()
+			return written, nil
+		}
+		for st.position >= s.length && !s.done {
+			s.cond.Wait()
+		}
+
+		if st.position < s.base {
+			st.skipped += s.base - st.position
+			st.position = s.base
+		}
+
+		length, done, err := s.length, s.done, s.err
+
+		if st.position >= length {
+			s.mutex.Unlock()
+			if done {
+				return written, err
+			}
+			continue
+		}
+
+		end := length
+		if h.stop >= 0 && h.stop < end {
+			end = h.stop
+		}
+		if end <= st.position {
+			s.mutex.Unlock()
+			return written, nil
+		}
+
+		toRead := end - st.position
+		if toRead > int64(len(buf)) {
+			toRead = int64(len(buf))
+		}
+
+		s.readRing(st.position, buf[:toRead])
+		s.sampleWindow(st)
+		s.mutex.Unlock()
+
+		n, writeErr := w.Write(buf[:toRead])
+		written += int64(n)
+
+		s.mutex.Lock()
+		st.position += int64(n)
+		s.mutex.Unlock()
+		s.cond.Broadcast()
+
+		if writeErr != nil {
+			return written, writeErr
+		}
+		if h.stop >= 0 && st.position >= h.stop {
+			return written, nil
+		}
+	}
+}